@@ -14,21 +14,23 @@ import (
 )
 
 const (
-	maxKnownTxs    = 32768 // Maximum transactions hashes to keep in the known list (prevent DOS)
-	maxKnownBlocks = 1024  // Maximum block hashes to keep in the known list (prevent DOS)
-
-	syncTimeout        = 30 * time.Second
-	requestRetryTicker = 15 * time.Second
+	syncTimeout = 30 * time.Second
 
 	maxBlocksPending = 1024
 	maxtxsPending    = 32768
+	maxErrorsPending = 256
 	maxQuitReq       = 256
+
+	schedulerTick = 100 * time.Millisecond
+
+	// defaultPeerSuspensionInterval is how long a peer committing a fatal
+	// error is barred from reconnecting, absent a Config override.
+	defaultPeerSuspensionInterval = 5 * time.Minute
 )
 
 var (
 	errGetBlockTimeout = errors.New("Get block Timeout")
 	errPeerDropped     = errors.New("Peer dropped")
-	errCommAbnorm      = errors.New("Peer communication abnormality")
 	errScamPeer        = errors.New("Scam peer")
 	errReqBlock        = errors.New("Request block error")
 )
@@ -41,6 +43,7 @@ type BlockRequestMessage struct {
 
 type pendingResponse struct {
 	block  *types.Block
+	size   int // wire size in bytes, used to feed the peer's recvMonitor
 	peerID string
 }
 
@@ -51,32 +54,132 @@ type txsNotify struct {
 
 //TODO: add retry mechanism
 type blockKeeper struct {
-	chain *protocol.Chain
-	sw    *p2p.Switch
-	peers *peerSet
+	chain      *protocol.Chain
+	sw         *p2p.Switch
+	peers      *peerSet
+	config     *Config
+	pool       *blockPool
+	suspension *peerSuspension
+	watchdog   *watchdog
 
 	pendingProcessCh chan *pendingResponse
 	txsProcessCh     chan *txsNotify
+	errorsCh         chan *peerError
+	hashesProcessCh  chan *hashChainResponse
 	quitReqBlockCh   chan *string
 
+	// blockWaiters routes a block arriving on pendingProcessCh to whichever
+	// BlockRequestWorker call is awaiting that height, since several calls
+	// (one per syncing peer) can be scheduling requests against the shared
+	// pool concurrently. See blockDispatchWorker.
+	waitersMtx   sync.Mutex
+	blockWaiters map[uint64]chan *pendingResponse
+
 	mtx sync.RWMutex
 }
 
-func newBlockKeeper(chain *protocol.Chain, sw *p2p.Switch, peers *peerSet, quitReqBlockCh chan *string) *blockKeeper {
+func newBlockKeeper(chain *protocol.Chain, sw *p2p.Switch, peers *peerSet, quitReqBlockCh chan *string, config *Config) *blockKeeper {
+	config = config.withDefaults()
+
+	errorsCh := make(chan *peerError, maxErrorsPending)
 	bk := &blockKeeper{
 		chain:            chain,
 		sw:               sw,
 		peers:            peers,
-		pendingProcessCh: make(chan *pendingResponse, maxBlocksPending),
-		txsProcessCh:     make(chan *txsNotify, maxtxsPending),
+		config:           config,
+		pool:             newBlockPool(errorsCh, config),
+		suspension:       newPeerSuspension(config.PeerSuspensionInterval),
+		pendingProcessCh: make(chan *pendingResponse, config.MaxBlocksPending),
+		txsProcessCh:     make(chan *txsNotify, config.MaxTxsPending),
+		errorsCh:         errorsCh,
+		hashesProcessCh:  make(chan *hashChainResponse, maxHashesPending),
 		quitReqBlockCh:   quitReqBlockCh,
+		blockWaiters:     make(map[uint64]chan *pendingResponse),
 	}
+	bk.watchdog = newWatchdog(bk)
 	go bk.txsProcessWorker()
+	go bk.errorsProcessWorker()
+	go bk.blockDispatchWorker()
+	go bk.watchdog.run()
 	return bk
 }
 
-func (bk *blockKeeper) AddBlock(block *types.Block, peerID string) {
-	bk.pendingProcessCh <- &pendingResponse{block: block, peerID: peerID}
+// NotifyHeight should be called whenever peerID sends a new block or hash
+// announcement. It feeds the idle-best-peer watchdog so a best peer that
+// later goes silent can be detected and dropped.
+func (bk *blockKeeper) NotifyHeight(peerID string) {
+	bk.watchdog.notifyAnnounce(peerID)
+}
+
+// IsPeerSuspended reports whether peerID is currently serving out a
+// suspension imposed after a fatal error, and should have its reconnect
+// attempt rejected by the switch.
+func (bk *blockKeeper) IsPeerSuspended(peerID string) bool {
+	return bk.suspension.isSuspended(peerID)
+}
+
+// errorsProcessWorker is the single point that turns a reported peerError
+// into a disciplinary action: fatal errors suspend the peer for
+// Config.PeerSuspensionInterval and add it to the scam list; non-fatal
+// errors just drop the current connection. Either way the peer is removed
+// from the block pool too, so pickPeer stops handing it new heights at once;
+// its in-flight requests are rescheduled when checkTimeouts finds them past
+// the request timeout.
+func (bk *blockKeeper) errorsProcessWorker() {
+	for perr := range bk.errorsCh {
+		log.WithFields(log.Fields{"peer": perr.peerID, "code": perr.code, "fatal": perr.fatal}).Warning(perr)
+		if perr.fatal {
+			bk.suspension.suspend(perr.peerID)
+			if peer := bk.peers.Peer(perr.peerID); peer != nil {
+				bk.sw.AddScamPeer(peer.getPeer())
+			}
+		}
+		bk.pool.removePeer(perr.peerID)
+		bk.peers.DropPeer(perr.peerID)
+	}
+}
+
+// registerBlockWaiter arranges for the block at height to be delivered on ch
+// once blockDispatchWorker sees it arrive on pendingProcessCh.
+func (bk *blockKeeper) registerBlockWaiter(height uint64, ch chan *pendingResponse) {
+	bk.waitersMtx.Lock()
+	bk.blockWaiters[height] = ch
+	bk.waitersMtx.Unlock()
+}
+
+// forgetBlockWaiter stops routing height to whichever channel last
+// registered for it, once the waiting BlockRequestWorker call has consumed
+// or timed out the request.
+func (bk *blockKeeper) forgetBlockWaiter(height uint64) {
+	bk.waitersMtx.Lock()
+	delete(bk.blockWaiters, height)
+	bk.waitersMtx.Unlock()
+}
+
+// blockDispatchWorker is the single, dedicated consumer of pendingProcessCh.
+// Several BlockRequestWorker calls (one per syncing peer) can be scheduling
+// requests against the shared blockPool at the same time; if each of them
+// read pendingProcessCh directly, Go's select would hand any given response
+// to whichever call's loop happened to wake up first, regardless of which
+// call actually requested that height, losing it into a goroutine that
+// isn't tracking that height and eventually suspending an innocent peer for
+// a timeout it already answered. Routing by height through blockWaiters
+// instead guarantees a response always reaches the call that asked for it.
+func (bk *blockKeeper) blockDispatchWorker() {
+	for resp := range bk.pendingProcessCh {
+		bk.waitersMtx.Lock()
+		waiter, ok := bk.blockWaiters[resp.block.Height]
+		bk.waitersMtx.Unlock()
+		if !ok {
+			log.WithField("height", resp.block.Height).Warning("blockKeeper: got a block with no worker awaiting it, dropping")
+			continue
+		}
+		waiter <- resp
+	}
+}
+
+func (bk *blockKeeper) AddBlock(block *types.Block, size int, peerID string) {
+	bk.pendingProcessCh <- &pendingResponse{block: block, size: size, peerID: peerID}
 }
 
 func (bk *blockKeeper) AddTx(tx *types.Tx, peerID string) {
@@ -90,72 +193,160 @@ func (bk *blockKeeper) IsCaughtUp() bool {
 	return bk.chain.Height() < height
 }
 
+// BlockRequestWorker drives the block pool: it seeds the pool with the given
+// peer's declared height, keeps the full range [chain.Height()+1,
+// maxPeerHeight] scheduled across every peer with spare capacity, and
+// delivers completed heights to chain.ProcessBlock strictly in order. Peers
+// that stall or go quiet are evicted by the pool and their work reassigned.
+//
+// Before fetching bodies it pulls the hash chain from peerID in batches of
+// BlockHashesBatchSize (see hash_sync.go) so bodies can be requested by hash,
+// in batches of Config.BlockBatchSize hashes per GetBlocksMessage, and so
+// each arriving block's PreviousBlockHash can be checked against the known
+// chain instead of trusting height alone. If the hash pull fails, it falls
+// back to plain one-height-at-a-time height-based requests.
+//
+// Multiple peers can each have their own BlockRequestWorker call running at
+// once, all scheduling against the same shared pool; each call only ever
+// consumes blocks it registered itself for via blockWaiters (see
+// blockDispatchWorker), so the calls can't steal each other's responses.
 func (bk *blockKeeper) BlockRequestWorker(peerID string, maxPeerHeight uint64) error {
+	if !bk.pool.setPeerHeight(peerID, bk.chain.Height(), maxPeerHeight) {
+		return errors.Wrap(errScamPeer, errCodeHeightMismatch.String())
+	}
+
 	chainHeight := bk.chain.Height()
 	num := chainHeight + 1
-	isOrphan := false
-	for num <= maxPeerHeight {
-		block, err := bk.BlockRequest(peerID, num)
-		if errors.Root(err) == errPeerDropped || errors.Root(err) == errGetBlockTimeout || errors.Root(err) == errReqBlock {
-			log.WithField("Peer abnormality. PeerID: ", peerID).Info(err)
-			bk.peers.DropPeer(peerID)
-			return errCommAbnorm
-		}
-		isOrphan, err = bk.chain.ProcessBlock(block)
-		if err != nil {
-			bk.sw.AddScamPeer(bk.peers.Peer(peerID).getPeer())
-			log.WithField("hash: ", block.Hash()).Errorf("blockKeeper fail process block %v", err)
-			return errScamPeer
+
+	// Seed our own tip's hash so the very first block of the batch, which
+	// attaches to it, gets its PreviousBlockHash checked too.
+	heightToHash := map[uint64][32]byte{chainHeight: bk.chain.BestBlockHash().Byte32()}
+	want := int(maxPeerHeight - chainHeight)
+	haveHashChain := false
+	if hashChain, err := bk.fetchHashChain(peerID, bk.chain.BestBlockHash(), want); err == nil {
+		for i, hash := range hashChain {
+			heightToHash[chainHeight+1+uint64(i)] = hash
 		}
-		if isOrphan {
-			num--
-			continue
+		haveHashChain = len(hashChain) > 0
+	} else {
+		log.WithField("peer", peerID).Warning("hash chain pull failed, falling back to height-based requests")
+	}
+
+	blocksCh := make(chan *pendingResponse, bk.config.MaxBlocksPending)
+
+	schedule := func(from, to uint64) {
+		bk.pool.schedule(from, to, func(peerID string, height uint64) error {
+			bk.registerBlockWaiter(height, blocksCh)
+			if err := bk.blockRequest(peerID, height); err != nil {
+				bk.forgetBlockWaiter(height)
+				return err
+			}
+			return nil
+		})
+	}
+	if haveHashChain {
+		// Heights past the end of the pulled hash chain have no hash to ask
+		// for, so they are requested by height instead.
+		hashTip := chainHeight + uint64(len(heightToHash)-1)
+		byHeight := schedule
+		schedule = func(from, to uint64) {
+			if from > hashTip {
+				byHeight(from, to)
+				return
+			}
+			if to > hashTip {
+				to = hashTip
+			}
+			bk.pool.scheduleBatched(from, to, bk.config.BlockBatchSize, func(peerID string, heights []uint64) error {
+				hashes := make([][32]byte, 0, len(heights))
+				for _, height := range heights {
+					hash, ok := heightToHash[height]
+					if !ok {
+						return errReqBlock
+					}
+					hashes = append(hashes, hash)
+				}
+				for _, height := range heights {
+					bk.registerBlockWaiter(height, blocksCh)
+				}
+				if err := bk.peers.requestBlocks(peerID, hashes); err != nil {
+					for _, height := range heights {
+						bk.forgetBlockWaiter(height)
+					}
+					return err
+				}
+				return nil
+			})
 		}
-		num = bk.chain.Height() + 1
 	}
-	return nil
-}
 
-func (bk *blockKeeper) blockRequest(peerID string, height uint64) error {
-	return bk.peers.requestBlockByHeight(peerID, height)
-}
+	received := make(map[uint64]*pendingResponse)
 
-func (bk *blockKeeper) BlockRequest(peerID string, height uint64) (*types.Block, error) {
-	var block *types.Block
+	scheduler := time.NewTicker(schedulerTick)
+	defer scheduler.Stop()
 
-	if err := bk.blockRequest(peerID, height); err != nil {
-		return nil, errReqBlock
-	}
-	retryTicker := time.Tick(requestRetryTicker)
-	syncWait := time.NewTimer(syncTimeout)
+	for num <= maxPeerHeight {
+		schedule(num, maxPeerHeight)
 
-	for {
 		select {
-		case pendingResponse := <-bk.pendingProcessCh:
-			block = pendingResponse.block
-			if strings.Compare(pendingResponse.peerID, peerID) != 0 {
-				log.Warning("From different peer")
-				continue
-			}
-			if block.Height != height {
-				log.Warning("Block height error")
-				continue
-			}
-			return block, nil
-		case <-retryTicker:
-			if err := bk.blockRequest(peerID, height); err != nil {
-				return nil, errReqBlock
+		case resp := <-blocksCh:
+			bk.forgetBlockWaiter(resp.block.Height)
+			bk.pool.complete(resp.block.Height, resp.size)
+			received[resp.block.Height] = resp
+
+		case <-scheduler.C:
+			for _, height := range bk.pool.checkTimeouts() {
+				bk.forgetBlockWaiter(height)
+				delete(received, height)
 			}
-		case <-syncWait.C:
-			log.Warning("Request block timeout")
-			return nil, errGetBlockTimeout
+
 		case peerid := <-bk.quitReqBlockCh:
 			if strings.Compare(*peerid, peerID) == 0 {
 				log.Info("Quite block request worker")
-				return nil, errPeerDropped
+				bk.pool.removePeer(peerID)
+				bk.errorsCh <- newPeerError(peerID, errCodePeerDropped, false, nil)
+				return errPeerDropped
 			}
 		}
+
+		for {
+			resp, ok := received[num]
+			if !ok {
+				break
+			}
+			delete(received, num)
+
+			if expected, ok := heightToHash[num-1]; ok && resp.block.PreviousBlockHash.Byte32() != expected {
+				log.WithField("height", num).Error("blockKeeper block doesn't link to the known hash chain")
+				bk.errorsCh <- newPeerError(resp.peerID, errCodeDecode, true, nil)
+				return errScamPeer
+			}
+
+			isOrphan, err := bk.chain.ProcessBlock(resp.block)
+			if err != nil {
+				log.WithField("hash: ", resp.block.Hash()).Errorf("blockKeeper fail process block %v", err)
+				bk.errorsCh <- newPeerError(resp.peerID, errCodeBadBlock, true, err)
+				return errScamPeer
+			}
+			if isOrphan {
+				// The block's parent isn't on our chain yet even though we
+				// believed we had it. Step back and fetch the parent height
+				// again instead of re-requesting this same height, which
+				// would just re-derive the same orphan forever.
+				log.WithField("height", num).Warning("blockKeeper got an orphan block, stepping back to refetch its parent")
+				if num > chainHeight+1 {
+					num--
+				}
+				break
+			}
+			num = bk.chain.Height() + 1
+		}
 	}
+	return nil
+}
+
+func (bk *blockKeeper) blockRequest(peerID string, height uint64) error {
+	return bk.peers.requestBlockByHeight(peerID, height)
 }
 
 func (bk *blockKeeper) txsProcessWorker() {
@@ -164,7 +355,7 @@ func (bk *blockKeeper) txsProcessWorker() {
 		log.Info("Receive new tx from remote peer. TxID:", tx.ID.String())
 		bk.peers.MarkTransaction(txsResponse.peerID, &tx.ID)
 		if isOrphan, err := bk.chain.ValidateTx(tx); err != nil && isOrphan == false {
-			bk.sw.AddScamPeer(bk.peers.Peer(txsResponse.peerID).getPeer())
+			bk.errorsCh <- newPeerError(txsResponse.peerID, errCodeInvalidTx, true, err)
 		}
 	}
 }
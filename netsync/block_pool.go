@@ -0,0 +1,348 @@
+package netsync
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMinRecvRate is the minimum tolerated receive rate, in
+	// bytes/sec, for a peer with an outstanding block request, absent a
+	// Config override. A peer whose request has overrun the request timeout
+	// is dropped if it is sustaining less than this.
+	defaultMinRecvRate = 7680
+
+	// defaultPeerRequestTimeout bounds how long we wait for a single block
+	// once a request has been issued to a peer, absent a Config override.
+	defaultPeerRequestTimeout = 15 * time.Second
+
+	// defaultMaxHeightDrift is how far ahead of our own height a peer is
+	// allowed to claim to be before we treat the announcement as a lie,
+	// absent a Config override. A peer 100 blocks ahead is plausible; one
+	// claiming to be a billion blocks ahead is not.
+	defaultMaxHeightDrift = 1000000000
+
+	// maxPendingPerPeer caps how many block requests we'll have outstanding
+	// against a single peer at once, so a long sync doesn't blast the whole
+	// missing range at the same one or two peers in a single schedule call.
+	maxPendingPerPeer = 16
+
+	// schedulingWindow bounds how many heights a single schedule call will
+	// consider, so the scheduler makes steady progress in small slices
+	// rather than walking the entire [from, to] range up front.
+	schedulingWindow = 128
+
+	// defaultBlockBatchSize is how many hashes are bundled into a single
+	// GetBlocksMessage body request, absent a Config override.
+	defaultBlockBatchSize = 64
+)
+
+// recvMonitor tracks the average receive rate of a single peer since it last
+// went from having no outstanding requests to having one.
+type recvMonitor struct {
+	mtx   sync.Mutex
+	start time.Time
+	bytes int64
+}
+
+func newRecvMonitor() *recvMonitor {
+	return &recvMonitor{start: time.Now()}
+}
+
+func (m *recvMonitor) update(n int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.bytes += int64(n)
+}
+
+// rate returns the average bytes/sec received since the monitor was reset.
+func (m *recvMonitor) rate() int64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	elapsed := time.Since(m.start).Seconds()
+	if elapsed < 1 {
+		return 0
+	}
+	return int64(float64(m.bytes) / elapsed)
+}
+
+// bpPeer is the block pool's bookkeeping for a single peer: its declared
+// height, outstanding requests and receive rate.
+type bpPeer struct {
+	id         string
+	height     uint64
+	numPending int32
+	monitor    *recvMonitor
+}
+
+func newBPPeer(id string, height uint64) *bpPeer {
+	return &bpPeer{
+		id:      id,
+		height:  height,
+		monitor: newRecvMonitor(),
+	}
+}
+
+func (p *bpPeer) incrPending() {
+	if p.numPending == 0 {
+		p.monitor = newRecvMonitor()
+	}
+	p.numPending++
+}
+
+func (p *bpPeer) decrPending(recvBytes int) {
+	p.numPending--
+	if p.numPending < 0 {
+		p.numPending = 0
+	}
+	p.monitor.update(recvBytes)
+}
+
+// blockRequest is an in-flight request for a single height, tracked so the
+// scheduler can detect slow peers and the timeout watcher can retire it.
+type blockRequest struct {
+	height    uint64
+	peerID    string
+	requestAt time.Time
+}
+
+// blockPool dispatches height ranges across multiple peers in parallel and
+// exposes the peer best suited to take on the next missing height. It mirrors
+// the shape of Tendermint's BlockPool, trimmed to what blockKeeper needs to
+// reassemble blocks strictly in order for chain.ProcessBlock.
+type blockPool struct {
+	mtx sync.Mutex
+
+	peers    map[string]*bpPeer
+	requests map[uint64]*blockRequest
+
+	errorsCh       chan *peerError
+	minRecvRate    int64
+	requestTimeout time.Duration
+	maxHeightDrift uint64
+}
+
+func newBlockPool(errorsCh chan *peerError, config *Config) *blockPool {
+	return &blockPool{
+		peers:          make(map[string]*bpPeer),
+		requests:       make(map[uint64]*blockRequest),
+		errorsCh:       errorsCh,
+		minRecvRate:    config.MinRecvRate,
+		requestTimeout: config.PeerRequestTimeout,
+		maxHeightDrift: config.MaxHeightDrift,
+	}
+}
+
+// setPeerHeight registers or refreshes a peer's declared height. Peers
+// claiming an absurd lead over our own height are treated as liars and
+// reported as a fatal error rather than admitted to the pool.
+func (pool *blockPool) setPeerHeight(peerID string, ourHeight, peerHeight uint64) bool {
+	if peerHeight > ourHeight+pool.maxHeightDrift {
+		pool.errorsCh <- newPeerError(peerID, errCodeHeightMismatch, true, nil)
+		return false
+	}
+
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	peer, ok := pool.peers[peerID]
+	if !ok {
+		pool.peers[peerID] = newBPPeer(peerID, peerHeight)
+		return true
+	}
+	peer.height = peerHeight
+	return true
+}
+
+func (pool *blockPool) removePeer(peerID string) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+	delete(pool.peers, peerID)
+}
+
+// pickPeer returns the id of the peer with spare capacity best able to serve
+// the given height: the one with the fewest pending requests, below
+// maxPendingPerPeer, that has already synced past it.
+func (pool *blockPool) pickPeer(height uint64) (string, bool) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	var best *bpPeer
+	for _, peer := range pool.peers {
+		if peer.height < height {
+			continue
+		}
+		if peer.numPending >= maxPendingPerPeer {
+			continue
+		}
+		if best == nil || peer.numPending < best.numPending {
+			best = peer
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	return best.id, true
+}
+
+// schedule dispatches requests for every height in [from, to] that isn't
+// already outstanding, spreading them across peers with spare capacity. It
+// only considers the first schedulingWindow heights of the range per call,
+// so a large resync is fed to peers in steady slices instead of flooding
+// every peer's pending queue with the whole range at once.
+func (pool *blockPool) schedule(from, to uint64, request func(peerID string, height uint64) error) {
+	if window := from + schedulingWindow - 1; window < to {
+		to = window
+	}
+	for h := from; h <= to; h++ {
+		pool.mtx.Lock()
+		_, pending := pool.requests[h]
+		pool.mtx.Unlock()
+		if pending {
+			continue
+		}
+
+		peerID, ok := pool.pickPeer(h)
+		if !ok {
+			continue
+		}
+		if err := request(peerID, h); err != nil {
+			continue
+		}
+
+		pool.mtx.Lock()
+		pool.peers[peerID].incrPending()
+		pool.requests[h] = &blockRequest{height: h, peerID: peerID, requestAt: time.Now()}
+		pool.mtx.Unlock()
+	}
+}
+
+// scheduleBatched behaves like schedule but groups up to batchSize
+// contiguous, not-yet-requested heights assigned to the same peer into a
+// single round trip (e.g. one GetBlocksMessage carrying several hashes),
+// while still tracking each height individually so per-height timeouts and
+// in-order delivery keep working unchanged.
+func (pool *blockPool) scheduleBatched(from, to uint64, batchSize int, request func(peerID string, heights []uint64) error) {
+	if window := from + schedulingWindow - 1; window < to {
+		to = window
+	}
+
+	for h := from; h <= to; {
+		pool.mtx.Lock()
+		_, pending := pool.requests[h]
+		pool.mtx.Unlock()
+		if pending {
+			h++
+			continue
+		}
+
+		peerID, ok := pool.pickPeer(h)
+		if !ok {
+			h++
+			continue
+		}
+
+		heights := make([]uint64, 0, batchSize)
+		for height := h; height <= to && len(heights) < batchSize; height++ {
+			pool.mtx.Lock()
+			_, taken := pool.requests[height]
+			pool.mtx.Unlock()
+			if taken {
+				break
+			}
+			heights = append(heights, height)
+		}
+		if len(heights) == 0 {
+			h++
+			continue
+		}
+
+		if err := request(peerID, heights); err != nil {
+			h++
+			continue
+		}
+
+		pool.mtx.Lock()
+		now := time.Now()
+		for _, height := range heights {
+			pool.peers[peerID].incrPending()
+			pool.requests[height] = &blockRequest{height: height, peerID: peerID, requestAt: now}
+		}
+		pool.mtx.Unlock()
+
+		h += uint64(len(heights))
+	}
+}
+
+// complete marks the request for height as satisfied, crediting recvBytes to
+// the serving peer's rate monitor.
+func (pool *blockPool) complete(height uint64, recvBytes int) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	req, ok := pool.requests[height]
+	if !ok {
+		return
+	}
+	if peer, ok := pool.peers[req.peerID]; ok {
+		peer.decrPending(recvBytes)
+	}
+	delete(pool.requests, height)
+}
+
+// pendingCount returns the number of block requests currently in flight.
+func (pool *blockPool) pendingCount() int {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+	return len(pool.requests)
+}
+
+// peerRates returns the current receive rate, in bytes/sec, of every peer
+// known to the pool.
+func (pool *blockPool) peerRates() map[string]int64 {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	rates := make(map[string]int64, len(pool.peers))
+	for id, peer := range pool.peers {
+		rates[id] = peer.monitor.rate()
+	}
+	return rates
+}
+
+// checkTimeouts scans outstanding requests that have overrun the configured
+// request timeout and, where the serving peer is gone from the pool or is
+// below the configured minimum receive rate, retires them and drops the peer
+// as a fatal error so it's both scam-listed and suspended rather than just
+// disconnected. A timed-out request whose peer still meets the minimum rate
+// is kept, and a peer below the minimum rate is not dropped before one of
+// its requests times out. It returns the heights that need to be
+// rescheduled.
+func (pool *blockPool) checkTimeouts() []uint64 {
+	pool.mtx.Lock()
+	now := time.Now()
+	var stale []uint64
+	dropped := make(map[string]bool)
+	for height, req := range pool.requests {
+		if now.Sub(req.requestAt) < pool.requestTimeout {
+			continue
+		}
+		peer, ok := pool.peers[req.peerID]
+		if ok && peer.monitor.rate() >= pool.minRecvRate {
+			continue
+		}
+		stale = append(stale, height)
+		dropped[req.peerID] = true
+		delete(pool.requests, height)
+	}
+	for peerID := range dropped {
+		delete(pool.peers, peerID)
+	}
+	pool.mtx.Unlock()
+
+	for peerID := range dropped {
+		pool.errorsCh <- newPeerError(peerID, errCodeTimeout, true, nil)
+	}
+	return stale
+}
@@ -0,0 +1,99 @@
+package netsync
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecvMonitorRate(t *testing.T) {
+	m := newRecvMonitor()
+	m.start = time.Now().Add(-2 * time.Second)
+	m.update(2048)
+
+	rate := m.rate()
+	if rate < 900 || rate > 1100 {
+		t.Fatalf("rate = %d, want ~1024 bytes/sec", rate)
+	}
+}
+
+func TestSetPeerHeightRejectsImplausibleDrift(t *testing.T) {
+	errorsCh := make(chan *peerError, 10)
+	config := DefaultConfig()
+	config.MaxHeightDrift = 100
+	pool := newBlockPool(errorsCh, config)
+
+	if pool.setPeerHeight("peer1", 10, 10+101) {
+		t.Fatal("peer claiming a height beyond MaxHeightDrift should be rejected")
+	}
+
+	select {
+	case perr := <-errorsCh:
+		if perr.code != errCodeHeightMismatch || !perr.fatal {
+			t.Fatalf("expected fatal errCodeHeightMismatch, got %+v", perr)
+		}
+	default:
+		t.Fatal("expected a peerError on errorsCh")
+	}
+
+	if !pool.setPeerHeight("peer1", 10, 10+50) {
+		t.Fatal("peer within MaxHeightDrift should be accepted")
+	}
+}
+
+func TestPickPeerRespectsPendingCap(t *testing.T) {
+	errorsCh := make(chan *peerError, 10)
+	pool := newBlockPool(errorsCh, DefaultConfig())
+	pool.setPeerHeight("peer1", 0, 1000)
+
+	pool.mtx.Lock()
+	pool.peers["peer1"].numPending = maxPendingPerPeer
+	pool.mtx.Unlock()
+
+	if _, ok := pool.pickPeer(1); ok {
+		t.Fatal("pickPeer should skip a peer already at its pending cap")
+	}
+}
+
+func TestScheduleBoundsWindow(t *testing.T) {
+	errorsCh := make(chan *peerError, 10)
+	pool := newBlockPool(errorsCh, DefaultConfig())
+	pool.setPeerHeight("peer1", 0, 1<<20)
+
+	var maxRequested uint64
+	pool.schedule(1, 1<<20, func(peerID string, height uint64) error {
+		if height > maxRequested {
+			maxRequested = height
+		}
+		return nil
+	})
+
+	if maxRequested > schedulingWindow {
+		t.Fatalf("schedule requested height %d beyond schedulingWindow %d", maxRequested, schedulingWindow)
+	}
+}
+
+func TestCheckTimeoutsReportsFatalError(t *testing.T) {
+	errorsCh := make(chan *peerError, 10)
+	config := DefaultConfig()
+	config.PeerRequestTimeout = time.Millisecond
+	pool := newBlockPool(errorsCh, config)
+	pool.setPeerHeight("peer1", 0, 10)
+
+	pool.mtx.Lock()
+	pool.requests[1] = &blockRequest{height: 1, peerID: "peer1", requestAt: time.Now().Add(-time.Hour)}
+	pool.mtx.Unlock()
+
+	stale := pool.checkTimeouts()
+	if len(stale) != 1 || stale[0] != 1 {
+		t.Fatalf("expected height 1 to be reported stale, got %v", stale)
+	}
+
+	select {
+	case perr := <-errorsCh:
+		if !perr.fatal {
+			t.Fatal("a timed-out peer should be reported as a fatal error")
+		}
+	default:
+		t.Fatal("expected a peerError on errorsCh")
+	}
+}
@@ -0,0 +1,96 @@
+package netsync
+
+import "time"
+
+// Config gathers the netsync tunables that used to be hardcoded constants so
+// they can be set from the bytom config file instead of recompiling. Build
+// one with DefaultConfig and override only the fields that matter; any field
+// left at its zero value is filled in from the defaults by newBlockKeeper.
+type Config struct {
+	SyncTimeout time.Duration
+
+	MaxBlocksPending int
+	MaxTxsPending    int
+
+	MinRecvRate            int64
+	PeerRequestTimeout     time.Duration
+	PeerSuspensionInterval time.Duration
+	IdleBestPeerTimeout    time.Duration
+	StatusUpdateInterval   time.Duration
+	BlockHashesBatchSize   int
+
+	// BlockBatchSize is how many hashes are bundled into a single
+	// GetBlocksMessage body request, once the hash chain is known.
+	BlockBatchSize int
+
+	// MaxHeightDrift is how far ahead of our own height a peer may claim to
+	// be before its announcement is treated as a lie.
+	MaxHeightDrift uint64
+}
+
+// DefaultConfig returns the netsync defaults used when the node config
+// doesn't override them; these match what used to be hardcoded package
+// constants.
+func DefaultConfig() *Config {
+	return &Config{
+		SyncTimeout: syncTimeout,
+
+		MaxBlocksPending: maxBlocksPending,
+		MaxTxsPending:    maxtxsPending,
+
+		MinRecvRate:            defaultMinRecvRate,
+		PeerRequestTimeout:     defaultPeerRequestTimeout,
+		PeerSuspensionInterval: defaultPeerSuspensionInterval,
+		IdleBestPeerTimeout:    defaultIdleBestPeerTimeout,
+		StatusUpdateInterval:   defaultStatusUpdateInterval,
+		BlockHashesBatchSize:   defaultBlockHashesBatchSize,
+		BlockBatchSize:         defaultBlockBatchSize,
+		MaxHeightDrift:         defaultMaxHeightDrift,
+	}
+}
+
+// withDefaults fills any zero-valued field of config from DefaultConfig, so
+// a caller building a Config literal with just one or two overrides doesn't
+// silently zero out everything else.
+func (config *Config) withDefaults() *Config {
+	if config == nil {
+		return DefaultConfig()
+	}
+
+	defaults := DefaultConfig()
+	merged := *config
+	if merged.SyncTimeout == 0 {
+		merged.SyncTimeout = defaults.SyncTimeout
+	}
+	if merged.MaxBlocksPending == 0 {
+		merged.MaxBlocksPending = defaults.MaxBlocksPending
+	}
+	if merged.MaxTxsPending == 0 {
+		merged.MaxTxsPending = defaults.MaxTxsPending
+	}
+	if merged.MinRecvRate == 0 {
+		merged.MinRecvRate = defaults.MinRecvRate
+	}
+	if merged.PeerRequestTimeout == 0 {
+		merged.PeerRequestTimeout = defaults.PeerRequestTimeout
+	}
+	if merged.PeerSuspensionInterval == 0 {
+		merged.PeerSuspensionInterval = defaults.PeerSuspensionInterval
+	}
+	if merged.IdleBestPeerTimeout == 0 {
+		merged.IdleBestPeerTimeout = defaults.IdleBestPeerTimeout
+	}
+	if merged.StatusUpdateInterval == 0 {
+		merged.StatusUpdateInterval = defaults.StatusUpdateInterval
+	}
+	if merged.BlockHashesBatchSize == 0 {
+		merged.BlockHashesBatchSize = defaults.BlockHashesBatchSize
+	}
+	if merged.BlockBatchSize == 0 {
+		merged.BlockBatchSize = defaults.BlockBatchSize
+	}
+	if merged.MaxHeightDrift == 0 {
+		merged.MaxHeightDrift = defaults.MaxHeightDrift
+	}
+	return &merged
+}
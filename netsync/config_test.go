@@ -0,0 +1,32 @@
+package netsync
+
+import "testing"
+
+func TestConfigWithDefaultsNil(t *testing.T) {
+	config := (*Config)(nil).withDefaults()
+	if *config != *DefaultConfig() {
+		t.Fatal("nil Config should fill in to exactly DefaultConfig")
+	}
+}
+
+func TestConfigWithDefaultsFillsZeroFields(t *testing.T) {
+	config := (&Config{MinRecvRate: 1234}).withDefaults()
+
+	if config.MinRecvRate != 1234 {
+		t.Errorf("MinRecvRate override was not preserved, got %d", config.MinRecvRate)
+	}
+
+	defaults := DefaultConfig()
+	if config.SyncTimeout != defaults.SyncTimeout {
+		t.Errorf("SyncTimeout = %v, want default %v", config.SyncTimeout, defaults.SyncTimeout)
+	}
+	if config.BlockHashesBatchSize != defaults.BlockHashesBatchSize {
+		t.Errorf("BlockHashesBatchSize = %d, want default %d", config.BlockHashesBatchSize, defaults.BlockHashesBatchSize)
+	}
+	if config.BlockBatchSize != defaults.BlockBatchSize {
+		t.Errorf("BlockBatchSize = %d, want default %d", config.BlockBatchSize, defaults.BlockBatchSize)
+	}
+	if config.MaxHeightDrift != defaults.MaxHeightDrift {
+		t.Errorf("MaxHeightDrift = %d, want default %d", config.MaxHeightDrift, defaults.MaxHeightDrift)
+	}
+}
@@ -0,0 +1,105 @@
+package netsync
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errCode classifies the reason a peer was reported as misbehaving, mirroring
+// the coded error scheme used by eth's protocol layer.
+type errCode int
+
+const (
+	errCodeBadBlock errCode = iota
+	errCodeInvalidTx
+	errCodeProtocolVersionMismatch
+	errCodeGenesisMismatch
+	errCodeTimeout
+	errCodeMsgTooLarge
+	errCodeInvalidMsgCode
+	errCodeDecode
+	errCodeExtraStatus
+	errCodeHeightMismatch
+	errCodePeerDropped
+)
+
+var errCodeToString = map[errCode]string{
+	errCodeBadBlock:                "bad block",
+	errCodeInvalidTx:               "invalid transaction",
+	errCodeProtocolVersionMismatch: "protocol version mismatch",
+	errCodeGenesisMismatch:         "genesis block mismatch",
+	errCodeTimeout:                 "request timed out",
+	errCodeMsgTooLarge:             "message too large",
+	errCodeInvalidMsgCode:          "invalid message code",
+	errCodeDecode:                  "message decode error",
+	errCodeExtraStatus:             "unsolicited status message",
+	errCodeHeightMismatch:          "implausible declared height",
+	errCodePeerDropped:             "peer dropped",
+}
+
+func (c errCode) String() string {
+	if s, ok := errCodeToString[c]; ok {
+		return s
+	}
+	return "unknown error"
+}
+
+// peerError reports a single misbehavior event attributable to a specific
+// peer. fatal errors get the peer suspended via PeerSuspensionInterval;
+// non-fatal errors just drop the current connection.
+type peerError struct {
+	peerID string
+	code   errCode
+	fatal  bool
+	err    error
+}
+
+func (e *peerError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("peer %s: %s: %v", e.peerID, e.code, e.err)
+	}
+	return fmt.Sprintf("peer %s: %s", e.peerID, e.code)
+}
+
+func newPeerError(peerID string, code errCode, fatal bool, err error) *peerError {
+	return &peerError{peerID: peerID, code: code, fatal: fatal, err: err}
+}
+
+// peerSuspension remembers peers that committed a fatal error and rejects
+// their reconnect attempts until the suspension expires.
+type peerSuspension struct {
+	mtx      sync.Mutex
+	interval time.Duration
+	until    map[string]time.Time
+}
+
+func newPeerSuspension(interval time.Duration) *peerSuspension {
+	return &peerSuspension{
+		interval: interval,
+		until:    make(map[string]time.Time),
+	}
+}
+
+// suspend bans peerID from reconnecting until the configured interval elapses.
+func (s *peerSuspension) suspend(peerID string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.until[peerID] = time.Now().Add(s.interval)
+}
+
+// isSuspended reports whether peerID is still serving out a suspension.
+func (s *peerSuspension) isSuspended(peerID string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	expiry, ok := s.until[peerID]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(s.until, peerID)
+		return false
+	}
+	return true
+}
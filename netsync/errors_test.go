@@ -0,0 +1,53 @@
+package netsync
+
+import (
+	"testing"
+	"time"
+)
+
+func TestErrCodeString(t *testing.T) {
+	cases := []struct {
+		code errCode
+		want string
+	}{
+		{errCodeBadBlock, "bad block"},
+		{errCodeTimeout, "request timed out"},
+		{errCodeHeightMismatch, "implausible declared height"},
+		{errCode(9999), "unknown error"},
+	}
+	for _, c := range cases {
+		if got := c.code.String(); got != c.want {
+			t.Errorf("errCode(%d).String() = %q, want %q", c.code, got, c.want)
+		}
+	}
+}
+
+func TestPeerErrorError(t *testing.T) {
+	withErr := newPeerError("peer1", errCodeBadBlock, true, errGetBlockTimeout)
+	if withErr.Error() == "" {
+		t.Fatal("expected non-empty error string")
+	}
+
+	withoutErr := newPeerError("peer1", errCodeTimeout, false, nil)
+	if withoutErr.Error() == "" {
+		t.Fatal("expected non-empty error string")
+	}
+}
+
+func TestPeerSuspension(t *testing.T) {
+	s := newPeerSuspension(50 * time.Millisecond)
+
+	if s.isSuspended("peer1") {
+		t.Fatal("peer should not be suspended before suspend is called")
+	}
+
+	s.suspend("peer1")
+	if !s.isSuspended("peer1") {
+		t.Fatal("peer should be suspended immediately after suspend")
+	}
+
+	time.Sleep(75 * time.Millisecond)
+	if s.isSuspended("peer1") {
+		t.Fatal("suspension should have expired")
+	}
+}
@@ -0,0 +1,90 @@
+package netsync
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultBlockHashesBatchSize is how many hashes are requested per
+// GetBlockHashesMessage round-trip, absent a Config override.
+const defaultBlockHashesBatchSize = 512
+
+const maxHashesPending = 64
+
+type hashChainResponse struct {
+	peerID string
+	hashes [][32]byte
+}
+
+// AddBlockHashes delivers a BlockHashesMessage response from peerID.
+func (bk *blockKeeper) AddBlockHashes(hashes [][32]byte, peerID string) {
+	bk.hashesProcessCh <- &hashChainResponse{peerID: peerID, hashes: hashes}
+}
+
+// HandleGetBlockHashes answers a peer's GetBlockHashesMessage by walking our
+// own chain forward from FromHash and sending back up to Max hashes, capped
+// by Config.BlockHashesBatchSize. An unknown FromHash gets an empty reply
+// rather than an error, since it just means our chains have diverged too far
+// for this round trip to help.
+func (bk *blockKeeper) HandleGetBlockHashes(peerID string, msg *GetBlockHashesMessage) {
+	max := msg.Max
+	if limit := uint64(bk.config.BlockHashesBatchSize); max > limit {
+		max = limit
+	}
+
+	from, err := bk.chain.GetBlockByHash(&msg.FromHash)
+	if err != nil {
+		log.WithFields(log.Fields{"peer": peerID, "hash": msg.FromHash}).Warning("blockKeeper: unknown FromHash in GetBlockHashesMessage")
+		bk.peers.sendBlockHashes(peerID, nil)
+		return
+	}
+
+	hashes := make([][32]byte, 0, max)
+	for height := from.Height + 1; uint64(len(hashes)) < max; height++ {
+		block, err := bk.chain.GetBlockByHeight(height)
+		if err != nil {
+			break
+		}
+		hashes = append(hashes, block.Hash().Byte32())
+	}
+	bk.peers.sendBlockHashes(peerID, hashes)
+}
+
+// fetchHashChain pulls up to `want` hashes from peerID, starting just after
+// fromHash, in batches of Config.BlockHashesBatchSize. It stops early if the
+// peer runs out of hashes to offer.
+func (bk *blockKeeper) fetchHashChain(peerID string, fromHash [32]byte, want int) ([][32]byte, error) {
+	chain := make([][32]byte, 0, want)
+	cursor := fromHash
+
+	for len(chain) < want {
+		batch := uint64(bk.config.BlockHashesBatchSize)
+		if remain := uint64(want - len(chain)); remain < batch {
+			batch = remain
+		}
+		if err := bk.peers.requestBlockHashes(peerID, cursor, batch); err != nil {
+			return nil, errReqBlock
+		}
+
+		syncWait := time.NewTimer(bk.config.SyncTimeout)
+		select {
+		case resp := <-bk.hashesProcessCh:
+			syncWait.Stop()
+			if resp.peerID != peerID {
+				log.Warning("From different peer")
+				continue
+			}
+			if len(resp.hashes) == 0 {
+				return chain, nil
+			}
+			chain = append(chain, resp.hashes...)
+			cursor = resp.hashes[len(resp.hashes)-1]
+
+		case <-syncWait.C:
+			log.WithField("peer", peerID).Warning("get block hashes timeout")
+			return nil, errGetBlockTimeout
+		}
+	}
+	return chain, nil
+}
@@ -0,0 +1,70 @@
+package netsync
+
+import (
+	"bytes"
+
+	wire "github.com/tendermint/go-wire"
+
+	"github.com/bytom/errors"
+)
+
+//maxBlockchainMessageSize bounds how large a single decoded BlockchainMessage
+//may be, to keep a malformed or hostile peer from forcing an unbounded alloc.
+const maxBlockchainMessageSize = 64 * 1024 * 1024
+
+//Message byte tags for the blockchain message set, registered with go-wire
+//below so a BlockchainMessage can travel inside a peer's generic envelope.
+const (
+	BlockchainHashesRequestByte  = byte(0x10)
+	BlockchainHashesResponseByte = byte(0x11)
+	BlockchainBlocksRequestByte  = byte(0x12)
+)
+
+//ErrBlockchainMessageDecode is returned by DecodeMessage when the wire bytes
+//don't decode into a registered BlockchainMessage.
+var ErrBlockchainMessageDecode = errors.New("error decoding blockchain message")
+
+//BlockchainMessage is the interface implemented by every message exchanged
+//during hash-then-body sync.
+type BlockchainMessage interface{}
+
+func init() {
+	wire.RegisterInterface(
+		struct{ BlockchainMessage }{},
+		wire.ConcreteType{O: &GetBlockHashesMessage{}, Byte: BlockchainHashesRequestByte},
+		wire.ConcreteType{O: &BlockHashesMessage{}, Byte: BlockchainHashesResponseByte},
+		wire.ConcreteType{O: &GetBlocksMessage{}, Byte: BlockchainBlocksRequestByte},
+	)
+}
+
+//DecodeMessage decodes a BlockchainMessage off the wire.
+func DecodeMessage(bz []byte) (msg BlockchainMessage, err error) {
+	n := int(0)
+	r := bytes.NewReader(bz)
+	msg = wire.ReadBinary(struct{ BlockchainMessage }{}, r, maxBlockchainMessageSize, &n, &err).(struct{ BlockchainMessage }).BlockchainMessage
+	if err != nil {
+		return nil, errors.Wrap(ErrBlockchainMessageDecode, err.Error())
+	}
+	return msg, nil
+}
+
+//GetBlockHashesMessage requests up to Max block hashes, walking forward from
+//the block identified by FromHash. It is the first phase of the two-phase
+//sync: pull the hash chain cheaply before fetching full bodies.
+type GetBlockHashesMessage struct {
+	FromHash [32]byte
+	Max      uint64
+}
+
+//BlockHashesMessage is the response to a GetBlockHashesMessage: the
+//requested hash chain, in ascending height order starting just after
+//FromHash.
+type BlockHashesMessage struct {
+	Hashes [][32]byte
+}
+
+//GetBlocksMessage requests the full block bodies for a batch of hashes
+//previously obtained via a BlockHashesMessage.
+type GetBlocksMessage struct {
+	Hashes [][32]byte
+}
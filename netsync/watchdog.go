@@ -0,0 +1,111 @@
+package netsync
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultIdleBestPeerTimeout is how long we tolerate the best peer going
+	// quiet on new block/hash announcements once we've caught up to its
+	// declared height, absent a Config override. A silent best peer past
+	// this point is assumed to be holding sync hostage and is dropped.
+	defaultIdleBestPeerTimeout = 120 * time.Second
+
+	// defaultStatusUpdateInterval is how often the watchdog logs a sync
+	// status snapshot, and how often it re-evaluates whether the idle timer
+	// should be armed or disarmed, absent a Config override.
+	defaultStatusUpdateInterval = 3 * time.Second
+)
+
+// watchdog drops the best peer if, after we've caught up to its declared
+// height, it goes silent for longer than the configured idle timeout, and
+// logs a periodic sync status snapshot so stalls are visible to operators.
+type watchdog struct {
+	bk             *blockKeeper
+	idleTimeout    time.Duration
+	statusInterval time.Duration
+	announceCh     chan string
+	quitCh         chan struct{}
+}
+
+func newWatchdog(bk *blockKeeper) *watchdog {
+	return &watchdog{
+		bk:             bk,
+		idleTimeout:    bk.config.IdleBestPeerTimeout,
+		statusInterval: bk.config.StatusUpdateInterval,
+		announceCh:     make(chan string, bk.config.MaxBlocksPending),
+		quitCh:         make(chan struct{}),
+	}
+}
+
+// notifyAnnounce should be called whenever peerID sends a new block or hash
+// announcement; it resets the idle timer if peerID is the current best peer.
+func (w *watchdog) notifyAnnounce(peerID string) {
+	select {
+	case w.announceCh <- peerID:
+	default:
+	}
+}
+
+func (w *watchdog) stop() {
+	close(w.quitCh)
+}
+
+func (w *watchdog) run() {
+	statusTicker := time.NewTicker(w.statusInterval)
+	defer statusTicker.Stop()
+
+	idleTimer := time.NewTimer(w.idleTimeout)
+	idleTimer.Stop()
+	defer idleTimer.Stop()
+	armed := false
+
+	for {
+		select {
+		case <-statusTicker.C:
+			w.logStatus()
+
+			bestPeerID, bestHeight := w.bk.peers.BestPeer()
+			caughtUp := bestPeerID != "" && w.bk.chain.Height() >= bestHeight
+			switch {
+			case caughtUp && !armed:
+				idleTimer.Reset(w.idleTimeout)
+				armed = true
+			case !caughtUp && armed:
+				idleTimer.Stop()
+				armed = false
+			}
+
+		case peerID := <-w.announceCh:
+			bestPeerID, _ := w.bk.peers.BestPeer()
+			if armed && peerID == bestPeerID {
+				idleTimer.Reset(w.idleTimeout)
+			}
+
+		case <-idleTimer.C:
+			bestPeerID, _ := w.bk.peers.BestPeer()
+			log.WithField("peer", bestPeerID).Warning("best peer idle past configured timeout, dropping")
+			w.bk.errorsCh <- newPeerError(bestPeerID, errCodeTimeout, false, nil)
+			armed = false
+
+		case <-w.quitCh:
+			return
+		}
+	}
+}
+
+func (w *watchdog) logStatus() {
+	bestPeerID, bestHeight := w.bk.peers.BestPeer()
+	fields := log.Fields{
+		"height":         w.bk.chain.Height(),
+		"bestPeerID":     bestPeerID,
+		"bestPeerHeight": bestHeight,
+		"pendingBlocks":  w.bk.pool.pendingCount(),
+	}
+	for peerID, rate := range w.bk.pool.peerRates() {
+		fields["recvRate_"+peerID] = rate
+	}
+	log.WithFields(fields).Info("netsync status")
+}